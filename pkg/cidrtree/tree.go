@@ -0,0 +1,87 @@
+// Package cidrtree implements a longest-prefix-match binary trie storing an
+// allow/deny bool per CIDR, with IPv4 and IPv6 entries sharing one tree via
+// 16-byte normalized keys, along the lines of Nebula's cidr.Tree6.
+package cidrtree
+
+import "net"
+
+type node struct {
+	isLeaf   bool
+	allow    bool
+	children [2]*node
+}
+
+// Tree is a CIDR-keyed allow/deny policy tree. The zero value is not usable;
+// use New.
+type Tree struct {
+	root *node
+}
+
+// New returns an empty Tree.
+func New() *Tree {
+	return &Tree{root: &node{}}
+}
+
+// Insert records allow/deny for cidr. A later Insert of a more specific CIDR
+// overrides a broader one for addresses in both; the reverse does not.
+func (t *Tree) Insert(cidr *net.IPNet, allow bool) {
+	key, bits := normalize(cidr.IP, cidr.Mask)
+
+	n := t.root
+	for i := 0; i < bits; i++ {
+		b := bitAt(key, i)
+		if n.children[b] == nil {
+			n.children[b] = &node{}
+		}
+		n = n.children[b]
+	}
+	n.isLeaf = true
+	n.allow = allow
+}
+
+// Allowed reports whether ip is allowed by the most specific CIDR covering
+// it. With no matching entry, ip defaults to allowed.
+func (t *Tree) Allowed(ip net.IP) bool {
+	allow, matched := t.lookup(ip)
+	if !matched {
+		return true
+	}
+	return allow
+}
+
+func (t *Tree) lookup(ip net.IP) (allow bool, matched bool) {
+	key := ip.To16()
+	if key == nil {
+		return false, false
+	}
+
+	n := t.root
+	if n.isLeaf {
+		allow, matched = n.allow, true
+	}
+	for i := 0; i < 128; i++ {
+		b := bitAt(key, i)
+		if n.children[b] == nil {
+			return
+		}
+		n = n.children[b]
+		if n.isLeaf {
+			allow, matched = n.allow, true
+		}
+	}
+	return
+}
+
+// normalize maps cidr.IP/mask onto a 16-byte key and the matching prefix
+// length, so a /24 IPv4 CIDR and a /120 IPv6 CIDR share the same tree.
+func normalize(ip net.IP, mask net.IPMask) (net.IP, int) {
+	ones, bits := mask.Size()
+	if bits == net.IPv4len*8 {
+		ones += (net.IPv6len - net.IPv4len) * 8
+	}
+	return ip.To16(), ones
+}
+
+func bitAt(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
@@ -0,0 +1,62 @@
+package cidrtree
+
+import (
+	"net"
+	"testing"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %s", s, err)
+	}
+	return n
+}
+
+func TestAllowedDefaultsTrueOnNoMatch(t *testing.T) {
+	tree := New()
+	tree.Insert(mustCIDR(t, "10.0.0.0/8"), false)
+
+	if !tree.Allowed(net.ParseIP("8.8.8.8")) {
+		t.Error("expected an address outside every entry to default to allowed")
+	}
+}
+
+func TestAllowedHonorsDenyEntry(t *testing.T) {
+	tree := New()
+	tree.Insert(mustCIDR(t, "10.0.0.0/8"), false)
+
+	if tree.Allowed(net.ParseIP("10.1.2.3")) {
+		t.Error("expected an address inside a denied CIDR to be denied")
+	}
+}
+
+func TestAllowedLongestPrefixWins(t *testing.T) {
+	tree := New()
+	tree.Insert(mustCIDR(t, "10.0.0.0/8"), false)
+	tree.Insert(mustCIDR(t, "10.1.0.0/16"), true)
+
+	if !tree.Allowed(net.ParseIP("10.1.2.3")) {
+		t.Error("expected the more specific /16 allow to win over the /8 deny")
+	}
+	if tree.Allowed(net.ParseIP("10.2.2.3")) {
+		t.Error("expected an address outside the /16 to still fall back to the /8 deny")
+	}
+}
+
+func TestAllowedSharesTreeAcrossFamilies(t *testing.T) {
+	tree := New()
+	tree.Insert(mustCIDR(t, "10.0.0.0/8"), false)
+	tree.Insert(mustCIDR(t, "fd00::/8"), false)
+
+	if tree.Allowed(net.ParseIP("10.1.2.3")) {
+		t.Error("expected the IPv4 deny entry to match an IPv4 address")
+	}
+	if tree.Allowed(net.ParseIP("fd00::1")) {
+		t.Error("expected the IPv6 deny entry to match an IPv6 address")
+	}
+	if !tree.Allowed(net.ParseIP("fc00::1")) {
+		t.Error("expected an IPv6 address outside the denied /8 to default to allowed")
+	}
+}
@@ -0,0 +1,344 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeikoSchlittermann/gof5/pkg/cidrtree"
+	"github.com/miekg/dns"
+)
+
+const negativeCacheTTL = 30 * time.Second
+
+// upstream resolves a single DNS query against one configured nameserver,
+// regardless of the wire format it uses (plain UDP, DoT or DoH).
+type upstream interface {
+	Exchange(req *dns.Msg) (*dns.Msg, error)
+}
+
+// udpUpstream talks plain DNS over UDP, e.g. "udp://1.1.1.1:53".
+type udpUpstream struct {
+	addr string
+}
+
+func (u *udpUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	c := new(dns.Client)
+	resp, _, err := c.Exchange(req, u.addr)
+	return resp, err
+}
+
+// tlsUpstream talks DNS-over-TLS, e.g. "tls://1.1.1.1:853".
+type tlsUpstream struct {
+	addr       string
+	serverName string
+}
+
+func (u *tlsUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	c := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{ServerName: u.serverName}}
+	resp, _, err := c.Exchange(req, u.addr)
+	return resp, err
+}
+
+// dohUpstream talks DNS-over-HTTPS, e.g. "https://1.1.1.1/dns-query".
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *dohUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	wire, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("doh: failed to pack query: %s", err)
+	}
+
+	httpReq, err := http.NewRequest("POST", u.url, bytes.NewReader(wire))
+	if err != nil {
+		return nil, fmt.Errorf("doh: failed to build request: %s", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("doh: request to %s failed: %s", u.url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("doh: failed to read response: %s", err)
+	}
+
+	out := new(dns.Msg)
+	if err := out.Unpack(body); err != nil {
+		return nil, fmt.Errorf("doh: failed to unpack response: %s", err)
+	}
+	return out, nil
+}
+
+// parseUpstream turns a config URL into its upstream implementation:
+// udp://host:port, tls://host:port or https://host/path. A bare host, or
+// host:port with no scheme at all (e.g. "10.0.0.53:5353"), is treated as
+// plain UDP; url.Parse either rejects those or misparses them as
+// "scheme:opaque", so they're special-cased before parsing.
+func parseUpstream(raw string) (upstream, error) {
+	if !strings.Contains(raw, "://") {
+		return &udpUpstream{addr: ensurePort(raw, "53")}, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %q: %s", raw, err)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return &udpUpstream{addr: ensurePort(u.Host, "53")}, nil
+	case "tls":
+		return &tlsUpstream{addr: ensurePort(u.Host, "853"), serverName: u.Hostname()}, nil
+	case "https":
+		return &dohUpstream{url: raw, client: &http.Client{Timeout: 5 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q in %q", u.Scheme, raw)
+	}
+}
+
+func ensurePort(addr, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, defaultPort)
+}
+
+// splitRule binds one config.SplitDNS suffix to its upstreams. A "!suffix"
+// entry is a negative exclusion: matching names fall through to the default
+// upstreams instead of this rule's.
+type splitRule struct {
+	suffix    string
+	deny      bool
+	upstreams []upstream
+}
+
+// splitResolver is the dns.Handler that walks the suffix rules built from
+// config.SplitDNS, forwarding matched queries to their configured upstream
+// and everything else to the F5 upstreams.
+type splitResolver struct {
+	rules            []splitRule
+	defaultUpstreams []upstream
+	cache            *dnsCache
+	policy           *cidrtree.Tree
+}
+
+// newSplitResolver builds the suffix rules from config.SplitDNS. The special
+// "f5-suffix" key auto-populates its suffix from the F5-pushed DNS suffix
+// (config.vpnDNSSuffix) and, if given no upstreams of its own, forwards to
+// the F5 DNS servers (config.vpnDNSServers) so VPN-side names keep resolving
+// through the tunnel. Answers whose A/AAAA records fall in a range denied by
+// policy are rewritten to NXDOMAIN.
+func newSplitResolver(config *Config, policy *cidrtree.Tree) (*splitResolver, error) {
+	r := &splitResolver{cache: newDNSCache(), policy: policy}
+
+	for _, ip := range config.vpnDNSServers {
+		r.defaultUpstreams = append(r.defaultUpstreams, &udpUpstream{addr: net.JoinHostPort(ip.String(), "53")})
+	}
+
+	for key, rawUpstreams := range config.SplitDNS {
+		suffix := key
+		deny := false
+		if strings.HasPrefix(key, "!") {
+			deny = true
+			suffix = strings.TrimPrefix(key, "!")
+		}
+
+		if key == "f5-suffix" {
+			if config.vpnDNSSuffix == "" {
+				continue
+			}
+			suffix = config.vpnDNSSuffix
+			if len(rawUpstreams) == 0 {
+				r.rules = append(r.rules, splitRule{suffix: strings.ToLower(suffix), upstreams: r.defaultUpstreams})
+				continue
+			}
+		}
+
+		ups := make([]upstream, 0, len(rawUpstreams))
+		for _, raw := range rawUpstreams {
+			u, err := parseUpstream(raw)
+			if err != nil {
+				return nil, err
+			}
+			ups = append(ups, u)
+		}
+		r.rules = append(r.rules, splitRule{suffix: strings.ToLower(suffix), deny: deny, upstreams: ups})
+	}
+
+	return r, nil
+}
+
+// match returns the upstreams to use for name, picking the longest matching
+// suffix rule, or the default F5 upstreams if nothing matches (or the
+// longest match is a negative exclusion).
+func (r *splitResolver) match(name string) []upstream {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	var best *splitRule
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if name != rule.suffix && !strings.HasSuffix(name, "."+rule.suffix) {
+			continue
+		}
+		if best == nil || len(rule.suffix) > len(best.suffix) {
+			best = rule
+		}
+	}
+
+	if best == nil || best.deny {
+		return r.defaultUpstreams
+	}
+	return best.upstreams
+}
+
+func (r *splitResolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	defer w.Close()
+
+	if len(req.Question) != 1 {
+		dns.HandleFailed(w, req)
+		return
+	}
+	q := req.Question[0]
+
+	if cached := r.cache.get(q); cached != nil {
+		cached.Id = req.Id
+		w.WriteMsg(cached)
+		return
+	}
+
+	var resp *dns.Msg
+	var err error
+	for _, u := range r.match(q.Name) {
+		resp, err = u.Exchange(req)
+		if err == nil && resp != nil {
+			break
+		}
+	}
+	if err != nil || resp == nil {
+		dns.HandleFailed(w, req)
+		return
+	}
+
+	if r.deniedByPolicy(resp) {
+		resp.Answer = nil
+		resp.Rcode = dns.RcodeNameError
+	}
+
+	r.cache.set(q, resp)
+	w.WriteMsg(resp)
+}
+
+// deniedByPolicy reports whether any A/AAAA record in resp's answer section
+// falls in a range denied by policy, so the caller can rewrite the answer
+// to NXDOMAIN instead of letting a browser route traffic through the tunnel.
+func (r *splitResolver) deniedByPolicy(resp *dns.Msg) bool {
+	if r.policy == nil {
+		return false
+	}
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rec := rr.(type) {
+		case *dns.A:
+			ip = rec.A
+		case *dns.AAAA:
+			ip = rec.AAAA
+		default:
+			continue
+		}
+		if !r.policy.Allowed(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// startDns runs the split-DNS resolver on config.ListenDNS, returning its
+// listen address for the resolv.conf "nameserver" line. The *dns.Server is
+// kept on l so restoreConfig can shut it down on disconnect.
+func startDns(l *vpnLink, config *Config) (string, error) {
+	resolver, err := newSplitResolver(config, l.policy)
+	if err != nil {
+		return "", fmt.Errorf("failed to build split-DNS resolver: %s", err)
+	}
+
+	addr := config.ListenDNS.String()
+	server := &dns.Server{Addr: net.JoinHostPort(addr, "53"), Net: "udp", Handler: resolver}
+	l.dnsServer = server
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			l.errChan <- fmt.Errorf("DNS server on %s failed: %s", addr, err)
+		}
+	}()
+
+	return addr, nil
+}
+
+// dnsCache caches answers by question, honoring the minimum TTL among
+// answer records and applying a short fixed TTL to negative answers.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	expires time.Time
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[string]dnsCacheEntry)}
+}
+
+func (c *dnsCache) get(q dns.Question) *dns.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[dnsCacheKey(q)]
+	if !ok || time.Now().After(e.expires) {
+		return nil
+	}
+	return e.msg.Copy()
+}
+
+func (c *dnsCache) set(q dns.Question, msg *dns.Msg) {
+	ttl := negativeCacheTTL
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 {
+		ttl = time.Duration(minAnswerTTL(msg.Answer)) * time.Second
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[dnsCacheKey(q)] = dnsCacheEntry{msg: msg.Copy(), expires: time.Now().Add(ttl)}
+}
+
+func dnsCacheKey(q dns.Question) string {
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(q.Name), q.Qtype, q.Qclass)
+}
+
+func minAnswerTTL(rrs []dns.RR) uint32 {
+	min := rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		if rr.Header().Ttl < min {
+			min = rr.Header().Ttl
+		}
+	}
+	if min == 0 {
+		min = 1
+	}
+	return min
+}
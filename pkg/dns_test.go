@@ -0,0 +1,106 @@
+package pkg
+
+import "testing"
+
+func TestParseUpstreamBareHostPort(t *testing.T) {
+	u, err := parseUpstream("10.0.0.53:5353")
+	if err != nil {
+		t.Fatalf("parseUpstream: %s", err)
+	}
+	udp, ok := u.(*udpUpstream)
+	if !ok {
+		t.Fatalf("expected a *udpUpstream, got %T", u)
+	}
+	if udp.addr != "10.0.0.53:5353" {
+		t.Errorf("expected addr %q, got %q", "10.0.0.53:5353", udp.addr)
+	}
+}
+
+func TestParseUpstreamBareHostDefaultsPort(t *testing.T) {
+	u, err := parseUpstream("10.0.0.53")
+	if err != nil {
+		t.Fatalf("parseUpstream: %s", err)
+	}
+	udp, ok := u.(*udpUpstream)
+	if !ok {
+		t.Fatalf("expected a *udpUpstream, got %T", u)
+	}
+	if udp.addr != "10.0.0.53:53" {
+		t.Errorf("expected addr %q, got %q", "10.0.0.53:53", udp.addr)
+	}
+}
+
+func TestParseUpstreamSchemes(t *testing.T) {
+	if u, err := parseUpstream("udp://1.1.1.1:53"); err != nil {
+		t.Fatalf("udp: %s", err)
+	} else if _, ok := u.(*udpUpstream); !ok {
+		t.Errorf("udp://: expected *udpUpstream, got %T", u)
+	}
+
+	if u, err := parseUpstream("tls://1.1.1.1:853"); err != nil {
+		t.Fatalf("tls: %s", err)
+	} else if _, ok := u.(*tlsUpstream); !ok {
+		t.Errorf("tls://: expected *tlsUpstream, got %T", u)
+	}
+
+	if u, err := parseUpstream("https://1.1.1.1/dns-query"); err != nil {
+		t.Fatalf("https: %s", err)
+	} else if _, ok := u.(*dohUpstream); !ok {
+		t.Errorf("https://: expected *dohUpstream, got %T", u)
+	}
+}
+
+func TestParseUpstreamUnsupportedScheme(t *testing.T) {
+	if _, err := parseUpstream("ftp://1.1.1.1"); err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+}
+
+func TestSplitResolverMatchLongestSuffixWins(t *testing.T) {
+	internal := &udpUpstream{addr: "10.0.0.1:53"}
+	public := &udpUpstream{addr: "8.8.8.8:53"}
+	r := &splitResolver{
+		defaultUpstreams: []upstream{public},
+		rules: []splitRule{
+			{suffix: "example.com", upstreams: []upstream{internal}},
+			{suffix: "vpn.example.com", upstreams: []upstream{internal, public}},
+		},
+	}
+
+	ups := r.match("host.vpn.example.com")
+	if len(ups) != 2 || ups[0] != internal || ups[1] != public {
+		t.Errorf("expected the longer vpn.example.com suffix's upstreams, got %v", ups)
+	}
+
+	ups = r.match("other.example.com")
+	if len(ups) != 1 || ups[0] != internal {
+		t.Errorf("expected the example.com suffix's upstreams, got %v", ups)
+	}
+}
+
+func TestSplitResolverMatchFallsBackToDefault(t *testing.T) {
+	public := &udpUpstream{addr: "8.8.8.8:53"}
+	r := &splitResolver{defaultUpstreams: []upstream{public}}
+
+	ups := r.match("unrelated.net")
+	if len(ups) != 1 || ups[0] != public {
+		t.Errorf("expected the default upstreams for an unmatched name, got %v", ups)
+	}
+}
+
+func TestSplitResolverMatchNegativeExclusionFallsBackToDefault(t *testing.T) {
+	internal := &udpUpstream{addr: "10.0.0.1:53"}
+	public := &udpUpstream{addr: "8.8.8.8:53"}
+	r := &splitResolver{
+		defaultUpstreams: []upstream{public},
+		rules: []splitRule{
+			{suffix: "example.com", upstreams: []upstream{internal}},
+			{suffix: "intranet.example.com", deny: true},
+		},
+	}
+
+	ups := r.match("host.intranet.example.com")
+	if len(ups) != 1 || ups[0] != public {
+		t.Errorf("expected a negative exclusion to fall back to the default upstreams, got %v", ups)
+	}
+}
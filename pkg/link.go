@@ -1,24 +1,24 @@
 package pkg
 
 import (
-	"bufio"
 	"bytes"
-	"crypto/tls"
-	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"sync"
 	"syscall"
 
 	//goCIDR "github.com/apparentlymart/go-cidr/cidr"
-	"github.com/pion/dtls/v2"
+	"github.com/HeikoSchlittermann/gof5/pkg/cidrtree"
+	"github.com/miekg/dns"
 	"github.com/songgao/water"
 	"github.com/vishvananda/netlink"
 	"golang.zx2c4.com/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
 const (
@@ -49,6 +49,15 @@ type vpnLink struct {
 	mtu               []byte
 	mtuInt            uint16
 	gateways          []net.IP
+	gvisorStack       *stack.Stack
+	origConfig        *Config
+	policy            *cidrtree.Tree
+	lanExemption      *lanExemption
+	sighup            chan os.Signal
+	socksListener     net.Listener
+	httpProxyServer   *http.Server
+	dnsServer         *dns.Server
+	closing           bool
 }
 
 type myConn interface {
@@ -91,17 +100,6 @@ func (t *myTun) Write(b []byte) (int, error) {
 
 // init a TLS connection
 func initConnection(server string, config *Config, favorite *Favorite) (*vpnLink, error) {
-	// TLS
-	getUrl := fmt.Sprintf("https://%s/myvpn?sess=%s&hostname=%s&hdlc_framing=%s&ipv4=%s&ipv6=%s&Z=%s",
-		server,
-		favorite.Object.SessionID,
-		base64.StdEncoding.EncodeToString([]byte("my-hostname")),
-		Bool(config.PPPD),
-		favorite.Object.IPv4,
-		Bool(config.IPv6 && bool(favorite.Object.IPv6)),
-		favorite.Object.UrZ,
-	)
-
 	serverIPs, err := net.LookupIP(server)
 	if err != nil || len(serverIPs) == 0 {
 		return nil, fmt.Errorf("failed to resolve %s: %s", server, err)
@@ -116,92 +114,99 @@ func initConnection(server string, config *Config, favorite *Favorite) (*vpnLink
 		termChan:  make(chan os.Signal, 1),
 	}
 
-	if config.DTLS && favorite.Object.TunnelDTLS {
-		s := fmt.Sprintf("%s:%s", server, favorite.Object.TunnelPortDTLS)
-		log.Printf("Connecting to %s using DTLS", s)
-		addr, err := net.ResolveUDPAddr("udp", s)
-		if err != nil {
-			return nil, fmt.Errorf("failed to resolve UDP address: %s", err)
-		}
-		conf := &dtls.Config{
-			InsecureSkipVerify: config.InsecureTLS,
-		}
-		link.conn, err = dtls.Dial("udp4", addr, conf)
-		if err != nil {
-			return nil, fmt.Errorf("failed to dial %s:%s: %s", server, favorite.Object.TunnelPortDTLS, err)
-		}
+	// snapshot the config as it was at connect time, so a SIGHUP reload
+	// followed by termination still restores and cleans up correctly
+	origConfig := *config
+	origConfig.Routes = append([]*net.IPNet(nil), config.Routes...)
+	origConfig.DNS = append([]net.IP(nil), config.DNS...)
+	link.origConfig = &origConfig
+
+	link.policy = buildPolicy(config)
+
+	if lan, err := detectLANExemption(); err != nil {
+		log.Printf("Could not detect local LAN subnet, not exempting it from the tunnel: %s", err)
 	} else {
-		conf := &tls.Config{
-			InsecureSkipVerify: config.InsecureTLS,
-		}
-		link.conn, err = tls.Dial("tcp", fmt.Sprintf("%s:443", server), conf)
-		if err != nil {
-			return nil, fmt.Errorf("failed to dial %s:443: %s", server, err)
-		}
+		link.lanExemption = lan
+	}
 
-		req, err := http.NewRequest("GET", getUrl, nil)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create VPN session request: %s", err)
-		}
-		req.Header.Set("User-Agent", userAgentVPN)
-		err = req.Write(link.conn)
-		if err != nil {
-			return nil, fmt.Errorf("failed to send VPN session request: %s", err)
-		}
+	if config.Path != "" {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		link.sighup = sighup
+		go link.watchSighup(sighup, config.Path, config, favorite)
+	}
 
-		if debug {
-			log.Printf("URL: %s", getUrl)
-		}
+	transport, err := selectTransport(config, favorite)
+	if err != nil {
+		return nil, err
+	}
 
-		resp, err := http.ReadResponse(bufio.NewReader(link.conn), nil)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get initial VPN connection response: %s", err)
-		}
-		resp.Body.Close()
-
-		link.localIPv4 = net.ParseIP(resp.Header.Get("X-VPN-client-IP"))
-		link.serverIPv4 = net.ParseIP(resp.Header.Get("X-VPN-server-IP"))
-		link.localIPv6 = net.ParseIP(resp.Header.Get("X-VPN-client-IPv6"))
-		link.serverIPv6 = net.ParseIP(resp.Header.Get("X-VPN-server-IPv6"))
-
-		if debug {
-			log.Printf("Client IP: %s", link.localIPv4)
-			log.Printf("Server IP: %s", link.serverIPv4)
-			if link.localIPv6 != nil {
-				log.Printf("Client IPv6: %s", link.localIPv6)
-			}
-			if link.localIPv6 != nil {
-				log.Printf("Server IPv6: %s", link.serverIPv6)
-			}
-		}
+	conn, info, err := transport.Dial(server, config, favorite)
+	if err != nil {
+		return nil, err
+	}
+	link.conn = conn
+
+	if info != nil {
+		link.localIPv4 = info.localIPv4
+		link.serverIPv4 = info.serverIPv4
+		link.localIPv6 = info.localIPv6
+		link.serverIPv6 = info.serverIPv6
 	}
 
 	if !config.PPPD {
-		if config.Water {
-			log.Printf("Using water module to create tunnel")
-			device, err := water.New(water.Config{
-				DeviceType: water.TUN,
-			})
+		switch config.TunStack {
+		case TunStackGVisor:
+			log.Printf("Using gVisor userspace stack, no kernel interface required")
+			iface, gstack, err := newGvisorTun(link.localIPv4, link.localIPv6, defaultMTU)
 			if err != nil {
-				return nil, fmt.Errorf("failed to create a %q interface: %s", water.TUN, err)
+				return nil, err
 			}
+			link.name = "gvisor"
+			link.iface = iface
+			link.gvisorStack = gstack
 
-			link.name = device.Name()
-			log.Printf("Created %s interface", link.name)
-			link.iface = myTun{myConn: device}
-		} else {
-			log.Printf("Using wireguard module to create tunnel")
-			device, err := tun.CreateTUN("", defaultMTU)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create an interface: %s", err)
+			if config.SocksListen != "" {
+				if err := startSocksProxy(link, gstack, config.SocksListen); err != nil {
+					return nil, err
+				}
+			}
+			if config.HTTPProxyListen != "" {
+				if err := startHTTPProxy(link, gstack, config.HTTPProxyListen); err != nil {
+					return nil, err
+				}
 			}
 
-			link.name, err = device.Name()
-			if err != nil {
-				return nil, fmt.Errorf("failed to get an interface name: %s", err)
+		case "", TunStackKernel:
+			if config.Water {
+				log.Printf("Using water module to create tunnel")
+				device, err := water.New(water.Config{
+					DeviceType: water.TUN,
+				})
+				if err != nil {
+					return nil, fmt.Errorf("failed to create a %q interface: %s", water.TUN, err)
+				}
+
+				link.name = device.Name()
+				log.Printf("Created %s interface", link.name)
+				link.iface = myTun{myConn: device}
+			} else {
+				log.Printf("Using wireguard module to create tunnel")
+				device, err := tun.CreateTUN("", defaultMTU)
+				if err != nil {
+					return nil, fmt.Errorf("failed to create an interface: %s", err)
+				}
+
+				link.name, err = device.Name()
+				if err != nil {
+					return nil, fmt.Errorf("failed to get an interface name: %s", err)
+				}
+				log.Printf("Created %s interface", link.name)
+				link.iface = myTun{Device: device}
 			}
-			log.Printf("Created %s interface", link.name)
-			link.iface = myTun{Device: device}
+
+		default:
+			return nil, fmt.Errorf("unsupported tunStack %q", config.TunStack)
 		}
 	}
 
@@ -214,17 +219,6 @@ func (l *vpnLink) errorHandler() {
 	l.termChan <- syscall.SIGINT
 }
 
-func cidrContainsIPs(cidr *net.IPNet, ips []net.IP) bool {
-	for _, ip := range ips {
-		if cidr.Contains(ip) {
-			//net, ok := goCIDR.PreviousSubnet(&net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}, 17)
-			//log.Printf("Previous: %s %t", net, ok)
-			return true
-		}
-	}
-	return false
-}
-
 // wait for pppd and config DNS and routes
 func (l *vpnLink) waitAndConfig(config *Config, fav *Favorite) {
 	var err error
@@ -243,6 +237,20 @@ func (l *vpnLink) waitAndConfig(config *Config, fav *Favorite) {
 		}
 	}
 
+	// define DNS servers, provided by F5
+	config.vpnDNSServers = fav.Object.DNS
+	config.vpnDNSSuffix = fav.Object.DNSSuffix
+
+	if config.TunStack == TunStackGVisor {
+		// gvisor mode installs no kernel interface or routes, so neither the
+		// F5 DNS servers nor a local split resolver are reachable from the
+		// host: rewriting /etc/resolv.conf here would break host-wide DNS
+		// resolution for the life of the connection. Applications reach the
+		// VPN through the SOCKS5/HTTP proxy listeners instead.
+		log.Printf(printGreen, "Connection established")
+		return
+	}
+
 	l.Lock()
 	defer l.Unlock()
 	// read current resolv.conf
@@ -253,32 +261,34 @@ func (l *vpnLink) waitAndConfig(config *Config, fav *Favorite) {
 		return
 	}
 
-	// define DNS servers, provided by F5
 	log.Printf("Setting %s", resolvPath)
-	config.vpnDNSServers = fav.Object.DNS
-	dns := bytes.NewBufferString("# created by gof5 VPN client\n")
+	resolvBuf := bytes.NewBufferString("# created by gof5 VPN client\n")
 	if len(config.DNS) == 0 {
 		log.Printf("Forwarding DNS requests to %q", config.vpnDNSServers)
 		for _, v := range fav.Object.DNS {
-			if _, err = dns.WriteString("nameserver " + v.String() + "\n"); err != nil {
+			if _, err = resolvBuf.WriteString("nameserver " + v.String() + "\n"); err != nil {
 				l.errChan <- fmt.Errorf("failed to write DNS entry into buffer: %s", err)
 				return
 			}
 		}
 	} else {
-		listenAddr := startDns(l, config)
-		if _, err = dns.WriteString("nameserver " + listenAddr + "\n"); err != nil {
+		listenAddr, err := startDns(l, config)
+		if err != nil {
+			l.errChan <- err
+			return
+		}
+		if _, err = resolvBuf.WriteString("nameserver " + listenAddr + "\n"); err != nil {
 			l.errChan <- fmt.Errorf("failed to write DNS entry into buffer: %s", err)
 			return
 		}
 	}
 	if fav.Object.DNSSuffix != "" {
-		if _, err = dns.WriteString("search " + fav.Object.DNSSuffix + "\n"); err != nil {
+		if _, err = resolvBuf.WriteString("search " + fav.Object.DNSSuffix + "\n"); err != nil {
 			l.errChan <- fmt.Errorf("failed to write search DNS entry into buffer: %s", err)
 			return
 		}
 	}
-	if err = ioutil.WriteFile(resolvPath, dns.Bytes(), 0644); err != nil {
+	if err = ioutil.WriteFile(resolvPath, resolvBuf.Bytes(), 0644); err != nil {
 		l.errChan <- fmt.Errorf("failed to write %s: %s", resolvPath, err)
 		return
 	}
@@ -311,15 +321,17 @@ func (l *vpnLink) waitAndConfig(config *Config, fav *Favorite) {
 
 	// set custom routes
 	for _, cidr := range config.Routes {
-		if false && cidrContainsIPs(cidr, l.serverIPs) {
-			log.Printf("Skipping %s subnet", cidr)
-			//continue
+		if !l.policy.Allowed(cidr.IP) {
+			log.Printf("Skipping %s: denied by policy", cidr)
+			continue
 		}
 		if err = routeAdd(cidr, nil, 0, l.name); err != nil {
 			l.errChan <- err
 			return
 		}
 	}
+	punchLANHole(l.lanExemption)
+
 	l.routesReady = true
 	log.Printf(printGreen, "Connection established")
 }
@@ -329,6 +341,34 @@ func (l *vpnLink) restoreConfig(config *Config) {
 	l.Lock()
 	defer l.Unlock()
 
+	// restore against the connect-time snapshot, not the current running
+	// config; reloadConfig keeps the snapshot's Routes in step with the
+	// routes it installs, so termination after a reload removes those
+	if l.origConfig != nil {
+		config = l.origConfig
+	}
+
+	// mark intentional shutdown before tearing down the listeners, so their
+	// Accept/Serve loops don't report the resulting "closed" errors
+	l.closing = true
+
+	if l.sighup != nil {
+		signal.Stop(l.sighup)
+		close(l.sighup)
+	}
+
+	if l.socksListener != nil {
+		l.socksListener.Close()
+	}
+	if l.httpProxyServer != nil {
+		l.httpProxyServer.Close()
+	}
+	if l.dnsServer != nil {
+		if err := l.dnsServer.Shutdown(); err != nil {
+			log.Printf("Failed to shut down DNS server: %s", err)
+		}
+	}
+
 	defer func() {
 		if l.iface.Device != nil {
 			l.iface.Device.Close()
@@ -360,14 +400,14 @@ func (l *vpnLink) restoreConfig(config *Config) {
 		if l.ret == nil {
 			log.Printf("Removing routes from %s interface", l.name)
 			for _, cidr := range config.Routes {
-				if false && cidrContainsIPs(cidr, l.serverIPs) {
-					log.Printf("Skipping %s subnet", cidr)
-					//continue
+				if !l.policy.Allowed(cidr.IP) {
+					continue
 				}
 				if err := routeDel(cidr, nil, 0, l.name); err != nil {
 					log.Print(err)
 				}
 			}
+			removeLANHole(l.lanExemption)
 		}
 	}
 }
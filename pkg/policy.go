@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"log"
+	"net"
+
+	"github.com/HeikoSchlittermann/gof5/pkg/cidrtree"
+	"github.com/vishvananda/netlink"
+)
+
+var rfc1918 = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+
+// buildPolicy assembles the allow/deny CIDR policy from config.AllowCIDRs
+// and config.DenyCIDRs. The local LAN is kept reachable separately: see
+// detectLANExemption and punchLANHole. A single tree entry can't express
+// "carve this narrower subnet out of that broader route", which is what the
+// LAN needs when a configured route (e.g. the whole RFC1918 space) happens
+// to cover it.
+func buildPolicy(config *Config) *cidrtree.Tree {
+	tree := cidrtree.New()
+
+	for _, cidr := range config.DenyCIDRs {
+		tree.Insert(cidr, false)
+	}
+	for _, cidr := range config.AllowCIDRs {
+		tree.Insert(cidr, true)
+	}
+
+	return tree
+}
+
+// lanExemption identifies the local LAN subnet found on the interface
+// carrying the host's default route, together with the gateway and
+// interface that already reach it, so punchLANHole can keep it reachable
+// even when a broader configured route (e.g. a pushed 10.0.0.0/8) would
+// otherwise swallow it.
+type lanExemption struct {
+	subnet *net.IPNet
+	gw     net.IP
+	ifName string
+}
+
+// detectLANExemption returns the RFC1918 subnet assigned to the interface
+// carrying the host's default route, or nil if there is none.
+func detectLANExemption() (*lanExemption, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, route := range routes {
+		if route.Dst != nil || route.Gw == nil {
+			continue
+		}
+
+		link, err := netlink.LinkByIndex(route.LinkIndex)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if addr.IPNet != nil && isRFC1918(addr.IPNet.IP) {
+				return &lanExemption{subnet: addr.IPNet, gw: route.Gw, ifName: link.Attrs().Name}, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// punchLANHole re-installs the local LAN subnet as a route via its own
+// original gateway and interface. Being the longer, more specific prefix,
+// it keeps taking precedence over any broader configured route that covers
+// it (e.g. a 10.0.0.0/8 swallowing a home 10.0.1.0/24), regardless of which
+// was added to the routing table first.
+func punchLANHole(lan *lanExemption) {
+	if lan == nil {
+		return
+	}
+	log.Printf("Exempting local subnet %s from the tunnel", lan.subnet)
+	if err := routeAdd(lan.subnet, lan.gw, 0, lan.ifName); err != nil {
+		log.Printf("Failed to exempt local subnet %s from the tunnel: %s", lan.subnet, err)
+	}
+}
+
+// removeLANHole undoes punchLANHole on disconnect.
+func removeLANHole(lan *lanExemption) {
+	if lan == nil {
+		return
+	}
+	if err := routeDel(lan.subnet, lan.gw, 0, lan.ifName); err != nil {
+		log.Print(err)
+	}
+}
+
+func isRFC1918(ip net.IP) bool {
+	for _, raw := range rfc1918 {
+		_, block, err := net.ParseCIDR(raw)
+		if err == nil && block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+// +build !darwin
+
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+)
+
+// watchSighup re-reads path on every signal received on sighup and applies
+// the delta to the running tunnel without tearing it down. It runs until
+// sighup is closed.
+func (l *vpnLink) watchSighup(sighup chan os.Signal, path string, config *Config, fav *Favorite) {
+	for range sighup {
+		log.Printf("Received SIGHUP, reloading %s", path)
+		if err := l.reloadConfig(path, config, fav); err != nil {
+			log.Printf("Failed to reload %s: %s", path, err)
+		}
+	}
+}
+
+// reloadConfig re-reads the YAML config at path and diffs it against the
+// currently running config, applying only what changed: routes and DNS.
+// The F5-gateway host routes and serverRoutesReady are left untouched.
+func (l *vpnLink) reloadConfig(path string, config *Config, fav *Favorite) error {
+	newConfig, err := loadConfig(path)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if config.PPPD {
+		if !routesEqual(config.Routes, newConfig.Routes) {
+			log.Printf("Ignoring changed routes in %s: routes cannot be reloaded in PPPD mode", path)
+		}
+	} else if !routesEqual(config.Routes, newConfig.Routes) {
+		added, removed := diffRoutes(config.Routes, newConfig.Routes)
+		for _, cidr := range removed {
+			if !l.policy.Allowed(cidr.IP) {
+				// never added in the first place, nothing to remove
+				continue
+			}
+			log.Printf("Removing route %s", cidr)
+			if err := routeDel(cidr, nil, 0, l.name); err != nil {
+				log.Print(err)
+			}
+		}
+		for _, cidr := range added {
+			if !l.policy.Allowed(cidr.IP) {
+				log.Printf("Skipping %s: denied by policy", cidr)
+				continue
+			}
+			log.Printf("Adding route %s", cidr)
+			if err := routeAdd(cidr, nil, 0, l.name); err != nil {
+				log.Print(err)
+			}
+		}
+		config.Routes = newConfig.Routes
+		if l.origConfig != nil {
+			// keep the connect-time snapshot in step with what's actually
+			// installed, so restoreConfig tears down routes added by this
+			// reload instead of only what was there at connect time
+			l.origConfig.Routes = append([]*net.IPNet(nil), newConfig.Routes...)
+		}
+	}
+
+	if dnsConfigChanged(config, newConfig) {
+		if err := l.reloadDNS(config, newConfig, fav); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func dnsConfigChanged(old, new *Config) bool {
+	return !ipsEqual(old.DNS, new.DNS) || old.ResolvConfHandler != new.ResolvConfHandler
+}
+
+// reloadDNS rebuilds resolv.conf from scratch, with the same header and
+// nameserver/search lines configureDNS writes, and atomically installs it
+// via a temp-file rename. If ResolvConfHandler switched
+// to/from "watch", the existing watcher is stopped and a new one started
+// with the freshly written bytes.
+func (l *vpnLink) reloadDNS(config, newConfig *Config, fav *Favorite) error {
+	dns := bytes.NewBufferString(resolvConfHeader)
+
+	if len(newConfig.DNS) == 0 {
+		for _, v := range fav.Object.DNS {
+			if _, err := dns.WriteString("nameserver " + v.String() + "\n"); err != nil {
+				return fmt.Errorf("failed to write DNS entry into buffer: %s", err)
+			}
+		}
+	} else {
+		if _, err := dns.WriteString("nameserver " + newConfig.ListenDNS.String() + "\n"); err != nil {
+			return fmt.Errorf("failed to write DNS entry into buffer: %s", err)
+		}
+	}
+	if fav.Object.DNSSuffix != "" {
+		if _, err := dns.WriteString("search " + fav.Object.DNSSuffix + "\n"); err != nil {
+			return fmt.Errorf("failed to write search DNS entry into buffer: %s", err)
+		}
+	}
+
+	info, err := os.Stat(resolvPath)
+	perm := os.FileMode(0644)
+	if err == nil {
+		perm = info.Mode()
+	}
+
+	tmp := resolvPath + fmt.Sprintf(".gof5-reload-%d", os.Getpid())
+	if err := ioutil.WriteFile(tmp, dns.Bytes(), perm); err != nil {
+		return fmt.Errorf("failed to write %s: %s", tmp, err)
+	}
+	if err := os.Rename(tmp, resolvPath); err != nil {
+		return fmt.Errorf("failed to install %s: %s", resolvPath, err)
+	}
+
+	if newConfig.ResolvConfHandler != config.ResolvConfHandler {
+		if watching != nil {
+			close(watching)
+			watching = nil
+		}
+		if newConfig.ResolvConfHandler == "watch" {
+			watching = make(chan struct{})
+			if err := watchResolvConf(resolvPath, dns.Bytes(), watching); err != nil {
+				return fmt.Errorf("can't watch %s: %s", resolvPath, err)
+			}
+		}
+	}
+
+	config.DNS = newConfig.DNS
+	config.ResolvConfHandler = newConfig.ResolvConfHandler
+	return nil
+}
+
+func routesEqual(a, b []*net.IPNet) bool {
+	added, removed := diffRoutes(a, b)
+	return len(added) == 0 && len(removed) == 0
+}
+
+// diffRoutes returns the CIDRs present in b but not a (added) and the CIDRs
+// present in a but not b (removed).
+func diffRoutes(a, b []*net.IPNet) (added, removed []*net.IPNet) {
+	oldSet := make(map[string]*net.IPNet, len(a))
+	for _, r := range a {
+		oldSet[r.String()] = r
+	}
+	newSet := make(map[string]*net.IPNet, len(b))
+	for _, r := range b {
+		newSet[r.String()] = r
+	}
+	for k, r := range newSet {
+		if _, ok := oldSet[k]; !ok {
+			added = append(added, r)
+		}
+	}
+	for k, r := range oldSet {
+		if _, ok := newSet[k]; !ok {
+			removed = append(removed, r)
+		}
+	}
+	return
+}
+
+func ipsEqual(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,18 @@
+// +build darwin
+
+package pkg
+
+import (
+	"log"
+	"os"
+)
+
+// watchSighup on darwin: resolv.conf management there doesn't go through
+// the temp-file-rename/fsnotify path reload.go uses (see resolv_all.go's
+// "!darwin" build tag), so there is nothing to reload yet; just drain the
+// channel and say so.
+func (l *vpnLink) watchSighup(sighup chan os.Signal, path string, config *Config, fav *Favorite) {
+	for range sighup {
+		log.Printf("Received SIGHUP, but live reload is not yet supported on darwin")
+	}
+}
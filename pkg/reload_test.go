@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	"net"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %s", s, err)
+	}
+	return n
+}
+
+func TestDiffRoutesAddedAndRemoved(t *testing.T) {
+	a := []*net.IPNet{mustParseCIDR(t, "10.0.0.0/24"), mustParseCIDR(t, "10.0.1.0/24")}
+	b := []*net.IPNet{mustParseCIDR(t, "10.0.1.0/24"), mustParseCIDR(t, "10.0.2.0/24")}
+
+	added, removed := diffRoutes(a, b)
+	if len(added) != 1 || added[0].String() != "10.0.2.0/24" {
+		t.Errorf("expected added = [10.0.2.0/24], got %v", added)
+	}
+	if len(removed) != 1 || removed[0].String() != "10.0.0.0/24" {
+		t.Errorf("expected removed = [10.0.0.0/24], got %v", removed)
+	}
+}
+
+func TestDiffRoutesNoChange(t *testing.T) {
+	a := []*net.IPNet{mustParseCIDR(t, "10.0.0.0/24")}
+	b := []*net.IPNet{mustParseCIDR(t, "10.0.0.0/24")}
+
+	added, removed := diffRoutes(a, b)
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("expected no diff, got added=%v removed=%v", added, removed)
+	}
+}
+
+func TestRoutesEqual(t *testing.T) {
+	a := []*net.IPNet{mustParseCIDR(t, "10.0.0.0/24")}
+	b := []*net.IPNet{mustParseCIDR(t, "10.0.0.0/24")}
+	c := []*net.IPNet{mustParseCIDR(t, "10.0.1.0/24")}
+
+	if !routesEqual(a, b) {
+		t.Error("expected identical route sets to be equal")
+	}
+	if routesEqual(a, c) {
+		t.Error("expected different route sets to be unequal")
+	}
+}
+
+func TestIpsEqual(t *testing.T) {
+	a := []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("8.8.8.8")}
+	b := []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("8.8.8.8")}
+	c := []net.IP{net.ParseIP("1.1.1.1")}
+
+	if !ipsEqual(a, b) {
+		t.Error("expected identical IP lists to be equal")
+	}
+	if ipsEqual(a, c) {
+		t.Error("expected differently-sized IP lists to be unequal")
+	}
+}
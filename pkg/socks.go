@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// startSocksProxy listens on config.SocksListen and forwards every accepted
+// connection through the gVisor stack, so applications can reach VPN-side
+// resources without any kernel routing changes. The listener is kept on l
+// so restoreConfig can close it on disconnect.
+func startSocksProxy(l *vpnLink, s *stack.Stack, listen string) error {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %s", listen, err)
+	}
+	l.socksListener = ln
+
+	log.Printf("SOCKS5 proxy listening on %s", listen)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !l.closing {
+					l.errChan <- fmt.Errorf("socks proxy: %s", err)
+				}
+				return
+			}
+			go handleSocksConn(l, s, conn)
+		}
+	}()
+
+	return nil
+}
+
+func handleSocksConn(l *vpnLink, s *stack.Stack, conn net.Conn) {
+	defer conn.Close()
+
+	req, err := socks5Handshake(conn)
+	if err != nil {
+		log.Printf("socks proxy: %s", err)
+		return
+	}
+
+	if !l.policy.Allowed(req.dstIP) {
+		log.Printf("socks proxy: denying %s: denied by policy", req.dstIP)
+		socks5Reply(conn, socks5ReplyDenied)
+		return
+	}
+
+	dst, err := dialStack(s, req.dstIP, req.dstPort)
+	if err != nil {
+		log.Printf("socks proxy: failed to dial %s:%d: %s", req.dstIP, req.dstPort, err)
+		socks5Reply(conn, socks5ReplyUnreachable)
+		return
+	}
+	defer dst.Close()
+
+	socks5Reply(conn, socks5ReplyOK)
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(dst, conn); done <- struct{}{} }()
+	go func() { io.Copy(conn, dst); done <- struct{}{} }()
+	<-done
+}
+
+// dialStack dials a VPN-side TCP endpoint through the gVisor stack, taking
+// the place of a kernel route for the gvisor TunStack.
+func dialStack(s *stack.Stack, ip net.IP, port uint16) (net.Conn, error) {
+	proto := ipv4.ProtocolNumber
+	addrBytes := ip.To4()
+	if addrBytes == nil {
+		proto = ipv6.ProtocolNumber
+		addrBytes = ip.To16()
+	}
+
+	addr := tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.AddrFromSlice(addrBytes),
+		Port: port,
+	}
+	return gonet.DialTCP(s, addr, proto)
+}
+
+// startHTTPProxy runs a plain HTTP CONNECT proxy alongside the SOCKS5
+// listener, for child processes started with HTTP(S)_PROXY pointed at it.
+// The *http.Server is kept on l so restoreConfig can close it (and the
+// listener it owns) on disconnect.
+func startHTTPProxy(l *vpnLink, s *stack.Stack, listen string) error {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %s", listen, err)
+	}
+
+	log.Printf("HTTP proxy listening on %s", listen)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			httpConnect(l, s, w, r)
+		}),
+	}
+	l.httpProxyServer = srv
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			l.errChan <- fmt.Errorf("http proxy: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+func httpConnect(l *vpnLink, s *stack.Stack, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	host, portStr, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			http.Error(w, fmt.Sprintf("cannot resolve %s", host), http.StatusBadGateway)
+			return
+		}
+		ip = ips[0]
+	}
+	if !l.policy.Allowed(ip) {
+		http.Error(w, "denied by policy", http.StatusForbidden)
+		return
+	}
+
+	var port uint16
+	if _, err := fmt.Sscanf(portStr, "%d", &port); err != nil {
+		http.Error(w, "bad port", http.StatusBadRequest)
+		return
+	}
+
+	dst, err := dialStack(s, ip, port)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer dst.Close()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, _, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(dst, client); done <- struct{}{} }()
+	go func() { io.Copy(client, dst); done <- struct{}{} }()
+	<-done
+}
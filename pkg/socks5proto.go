@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// a minimal RFC 1928 SOCKS5 server: no-auth only, CONNECT only.
+const (
+	socks5Version  = 0x05
+	socks5NoAuth   = 0x00
+	socks5CmdConn  = 0x01
+	socks5AtypIPv4 = 0x01
+	socks5AtypName = 0x03
+	socks5AtypIPv6 = 0x04
+)
+
+type socks5ReplyCode byte
+
+const (
+	socks5ReplyOK          socks5ReplyCode = 0x00
+	socks5ReplyDenied      socks5ReplyCode = 0x02
+	socks5ReplyUnreachable socks5ReplyCode = 0x04
+)
+
+type socks5Request struct {
+	dstIP   net.IP
+	dstPort uint16
+}
+
+// socks5Handshake performs the version/auth negotiation and reads a single
+// CONNECT request, returning the requested destination.
+func socks5Handshake(conn net.Conn) (*socks5Request, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, fmt.Errorf("socks5: failed to read version header: %s", err)
+	}
+	if hdr[0] != socks5Version {
+		return nil, fmt.Errorf("socks5: unsupported version %d", hdr[0])
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, fmt.Errorf("socks5: failed to read auth methods: %s", err)
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return nil, fmt.Errorf("socks5: failed to write method selection: %s", err)
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return nil, fmt.Errorf("socks5: failed to read request: %s", err)
+	}
+	if req[0] != socks5Version || req[1] != socks5CmdConn {
+		return nil, fmt.Errorf("socks5: unsupported command %d", req[1])
+	}
+
+	var ip net.IP
+	switch req[3] {
+	case socks5AtypIPv4:
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, fmt.Errorf("socks5: failed to read IPv4 address: %s", err)
+		}
+		ip = net.IP(b)
+	case socks5AtypIPv6:
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, fmt.Errorf("socks5: failed to read IPv6 address: %s", err)
+		}
+		ip = net.IP(b)
+	case socks5AtypName:
+		lenBuf := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lenBuf); err != nil {
+			return nil, fmt.Errorf("socks5: failed to read domain length: %s", err)
+		}
+		name := make([]byte, lenBuf[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return nil, fmt.Errorf("socks5: failed to read domain name: %s", err)
+		}
+		ips, err := net.LookupIP(string(name))
+		if err != nil || len(ips) == 0 {
+			return nil, fmt.Errorf("socks5: failed to resolve %q: %s", name, err)
+		}
+		ip = ips[0]
+	default:
+		return nil, fmt.Errorf("socks5: unsupported address type %d", req[3])
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBuf); err != nil {
+		return nil, fmt.Errorf("socks5: failed to read port: %s", err)
+	}
+
+	return &socks5Request{dstIP: ip, dstPort: uint16(portBuf[0])<<8 | uint16(portBuf[1])}, nil
+}
+
+// socks5Reply writes a CONNECT reply carrying rep and a zero bind address,
+// which is all real SOCKS5 clients need once the tunnel is relayed.
+func socks5Reply(conn net.Conn, rep socks5ReplyCode) {
+	conn.Write([]byte{socks5Version, byte(rep), 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+}
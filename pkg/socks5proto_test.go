@@ -0,0 +1,85 @@
+package pkg
+
+import (
+	"net"
+	"testing"
+)
+
+// fakeConn feeds a fixed byte sequence to Read and records whatever is
+// written, just enough to drive socks5Handshake without a real socket.
+type fakeConn struct {
+	net.Conn
+	in  []byte
+	out []byte
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	n := copy(b, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) {
+	c.out = append(c.out, b...)
+	return len(b), nil
+}
+
+func TestSocks5HandshakeIPv4(t *testing.T) {
+	conn := &fakeConn{in: []byte{
+		0x05, 0x01, 0x00, // version, 1 method, no-auth
+		0x05, 0x01, 0x00, 0x01, // version, CONNECT, reserved, ATYP=IPv4
+		10, 0, 0, 1, // 10.0.0.1
+		0x01, 0xbb, // port 443
+	}}
+
+	req, err := socks5Handshake(conn)
+	if err != nil {
+		t.Fatalf("socks5Handshake: %s", err)
+	}
+	if !req.dstIP.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("expected dstIP 10.0.0.1, got %s", req.dstIP)
+	}
+	if req.dstPort != 443 {
+		t.Errorf("expected port 443, got %d", req.dstPort)
+	}
+	if len(conn.out) == 0 || conn.out[0] != socks5Version || conn.out[1] != socks5NoAuth {
+		t.Errorf("expected a no-auth method selection reply, got %v", conn.out)
+	}
+}
+
+func TestSocks5HandshakeIPv6(t *testing.T) {
+	conn := &fakeConn{in: append(append([]byte{
+		0x05, 0x01, 0x00,
+		0x05, 0x01, 0x00, 0x04,
+	}, net.ParseIP("fd00::1").To16()...), 0x00, 0x50)} // port 80
+
+	req, err := socks5Handshake(conn)
+	if err != nil {
+		t.Fatalf("socks5Handshake: %s", err)
+	}
+	if !req.dstIP.Equal(net.ParseIP("fd00::1")) {
+		t.Errorf("expected dstIP fd00::1, got %s", req.dstIP)
+	}
+	if req.dstPort != 80 {
+		t.Errorf("expected port 80, got %d", req.dstPort)
+	}
+}
+
+func TestSocks5HandshakeRejectsUnsupportedVersion(t *testing.T) {
+	conn := &fakeConn{in: []byte{0x04, 0x01, 0x00}}
+
+	if _, err := socks5Handshake(conn); err == nil {
+		t.Error("expected an error for an unsupported SOCKS version")
+	}
+}
+
+func TestSocks5HandshakeRejectsUnsupportedCommand(t *testing.T) {
+	conn := &fakeConn{in: []byte{
+		0x05, 0x01, 0x00,
+		0x05, 0x02, 0x00, 0x01, // BIND instead of CONNECT
+	}}
+
+	if _, err := socks5Handshake(conn); err == nil {
+		t.Error("expected an error for an unsupported command")
+	}
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// tunnelInfo carries the client/server IPs the gateway assigned for this
+// session, however the transport learned them (TLS response headers, or the
+// first control frame on transports that don't have headers).
+type tunnelInfo struct {
+	localIPv4  net.IP
+	serverIPv4 net.IP
+	localIPv6  net.IP
+	serverIPv6 net.IP
+}
+
+// Transport dials the F5 tunnel endpoint and returns the raw byte-stream
+// connection together with the negotiated tunnel info. TLSTransport,
+// DTLSTransport, H2Transport and QUICTransport each wrap a different wire
+// format, matching what F5 BIG-IP APM offers for config.Transport.
+type Transport interface {
+	Dial(server string, config *Config, favorite *Favorite) (myConn, *tunnelInfo, error)
+}
+
+// selectTransport resolves config.Transport to a Transport implementation,
+// preserving the existing DTLS-vs-TLS capability check when unset.
+func selectTransport(config *Config, favorite *Favorite) (Transport, error) {
+	switch config.Transport {
+	case "", "tls":
+		if config.DTLS && favorite.Object.TunnelDTLS {
+			return &DTLSTransport{}, nil
+		}
+		return &TLSTransport{}, nil
+	case "dtls":
+		return &DTLSTransport{}, nil
+	case "h2":
+		return &H2Transport{}, nil
+	case "quic":
+		return &QUICTransport{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported transport %q", config.Transport)
+	}
+}
+
+// writeControlFrame sends the client's session id as a "sess=..." line on
+// w, the first thing either transport writes on its control channel.
+// HTTP/2 forbids :path/:scheme pseudo-headers on CONNECT requests (RFC 7540
+// §8.3), so H2Transport can't carry favorite.Object.SessionID in the
+// request URL the way TLSTransport does; QUICTransport has no request/URL
+// at all. Both send it here instead, as data on the stream itself.
+func writeControlFrame(w io.Writer, sessionID string) error {
+	_, err := fmt.Fprintf(w, "sess=%s\n", sessionID)
+	return err
+}
+
+// readControlFrame reads the first control frame H2Transport and
+// QUICTransport send in place of the X-VPN-*-IP response headers
+// TLSTransport gets for free: a single "key=value;..." line naming the
+// client/server IPs the gateway assigned.
+func readControlFrame(br *bufio.Reader) (*tunnelInfo, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read control frame: %s", err)
+	}
+
+	info := &tunnelInfo{}
+	for _, kv := range strings.Split(strings.TrimSpace(line), ";") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "client4":
+			info.localIPv4 = net.ParseIP(parts[1])
+		case "server4":
+			info.serverIPv4 = net.ParseIP(parts[1])
+		case "client6":
+			info.localIPv6 = net.ParseIP(parts[1])
+		case "server6":
+			info.serverIPv6 = net.ParseIP(parts[1])
+		}
+	}
+	return info, nil
+}
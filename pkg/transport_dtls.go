@@ -0,0 +1,34 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/pion/dtls/v2"
+)
+
+// DTLSTransport dials the UDP/DTLS variant of the F5 APM tunnel. Like the
+// original code path, it does not learn the client/server IPs from the
+// handshake: Dial returns no tunnelInfo, so they stay unset.
+type DTLSTransport struct{}
+
+func (t *DTLSTransport) Dial(server string, config *Config, favorite *Favorite) (myConn, *tunnelInfo, error) {
+	s := fmt.Sprintf("%s:%s", server, favorite.Object.TunnelPortDTLS)
+	log.Printf("Connecting to %s using DTLS", s)
+
+	addr, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resolve UDP address: %s", err)
+	}
+
+	conf := &dtls.Config{
+		InsecureSkipVerify: config.InsecureTLS,
+	}
+	conn, err := dtls.Dial("udp4", addr, conf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dial %s:%s: %s", server, favorite.Object.TunnelPortDTLS, err)
+	}
+
+	return conn, nil, nil
+}
@@ -0,0 +1,73 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// H2Transport carries the tunneled PPP/HDLC frames over a single persistent
+// HTTP/2 CONNECT-style stream, for F5 gateways that offer an h2 transport
+// instead of the classic TLS+HTTP/1.1 upgrade.
+type H2Transport struct{}
+
+// h2Conn adapts one H2 stream's request body (write side) and response body
+// (read side) to the myConn interface.
+type h2Conn struct {
+	body io.ReadCloser
+	br   *bufio.Reader
+	pw   *io.PipeWriter
+}
+
+func (c *h2Conn) Write(b []byte) (int, error) { return c.pw.Write(b) }
+func (c *h2Conn) Read(b []byte) (int, error)  { return c.br.Read(b) }
+
+func (c *h2Conn) Close() error {
+	c.pw.Close()
+	return c.body.Close()
+}
+
+func (t *H2Transport) Dial(server string, config *Config, favorite *Favorite) (myConn, *tunnelInfo, error) {
+	tr := &http2.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: config.InsecureTLS},
+	}
+
+	pr, pw := io.Pipe()
+	// HTTP/2 strips :path/:scheme from CONNECT requests, so the session id
+	// can't ride the URL like TLSTransport's query string does; send it as
+	// the first thing written on the request body instead.
+	go func() {
+		if err := writeControlFrame(pw, favorite.Object.SessionID); err != nil {
+			pw.CloseWithError(err)
+		}
+	}()
+
+	req, err := http.NewRequest(http.MethodConnect, fmt.Sprintf("https://%s/myvpn-h2", server), pr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to build H2 tunnel request: %s", err)
+	}
+	req.Header.Set("User-Agent", userAgentVPN)
+
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open H2 tunnel stream to %s: %s", server, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("H2 tunnel handshake to %s rejected: %s", server, resp.Status)
+	}
+
+	conn := &h2Conn{body: resp.Body, br: bufio.NewReader(resp.Body), pw: pw}
+
+	info, err := readControlFrame(conn.br)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, info, nil
+}
@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICTransport carries the tunnel over QUIC: one stream for the initial
+// control frame (the client/server IPs, matching how H2Transport negotiates
+// them) and a second stream for the tunneled PPP/HDLC frames, the same split
+// Xray-core uses layering gVisor over WireGuard's UDP.
+type QUICTransport struct{}
+
+// quicConn adapts a QUIC data stream to myConn, closing the control stream
+// and the underlying connection alongside it.
+type quicConn struct {
+	ctrl quic.Stream
+	data quic.Stream
+	conn quic.Connection
+}
+
+func (c *quicConn) Write(b []byte) (int, error) { return c.data.Write(b) }
+func (c *quicConn) Read(b []byte) (int, error)  { return c.data.Read(b) }
+
+func (c *quicConn) Close() error {
+	c.ctrl.Close()
+	c.data.Close()
+	return c.conn.CloseWithError(0, "")
+}
+
+func (t *QUICTransport) Dial(server string, config *Config, favorite *Favorite) (myConn, *tunnelInfo, error) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: config.InsecureTLS,
+		NextProtos:         []string{"gof5-vpn"},
+	}
+	quicConf := &quic.Config{}
+
+	if config.CongestionControl != "" && config.CongestionControl != "cubic" {
+		// quic-go does not (yet) expose a pluggable congestion-control hook
+		// in its public Config, so BBR tuning can't be wired in here; cubic
+		// remains the default, as in Xray-core's gVisor TUN work.
+		log.Printf("Congestion control %q requested but not supported, using cubic", config.CongestionControl)
+	}
+
+	addr := fmt.Sprintf("%s:%s", server, favorite.Object.TunnelPortDTLS)
+	conn, err := quic.DialAddr(context.Background(), addr, tlsConf, quicConf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dial QUIC %s: %s", addr, err)
+	}
+
+	ctrl, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open QUIC control stream to %s: %s", addr, err)
+	}
+	data, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open QUIC data stream to %s: %s", addr, err)
+	}
+
+	// QUIC has no request/URL to carry the session id in at all; send it as
+	// the first line on the control stream, same as H2Transport's body.
+	if err := writeControlFrame(ctrl, favorite.Object.SessionID); err != nil {
+		conn.CloseWithError(0, "")
+		return nil, nil, fmt.Errorf("failed to send session id to %s: %s", addr, err)
+	}
+
+	info, err := readControlFrame(bufio.NewReader(ctrl))
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, nil, err
+	}
+
+	return &quicConn{ctrl: ctrl, data: data, conn: conn}, info, nil
+}
@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// TLSTransport dials the classic F5 APM tunnel: a TLS connection carrying an
+// HTTP/1.1 upgrade request, with the client/server IPs returned as
+// X-VPN-*-IP response headers.
+type TLSTransport struct{}
+
+func (t *TLSTransport) Dial(server string, config *Config, favorite *Favorite) (myConn, *tunnelInfo, error) {
+	getUrl := fmt.Sprintf("https://%s/myvpn?sess=%s&hostname=%s&hdlc_framing=%s&ipv4=%s&ipv6=%s&Z=%s",
+		server,
+		favorite.Object.SessionID,
+		base64.StdEncoding.EncodeToString([]byte("my-hostname")),
+		Bool(config.PPPD),
+		favorite.Object.IPv4,
+		Bool(config.IPv6 && bool(favorite.Object.IPv6)),
+		favorite.Object.UrZ,
+	)
+
+	conf := &tls.Config{
+		InsecureSkipVerify: config.InsecureTLS,
+	}
+	conn, err := tls.Dial("tcp", fmt.Sprintf("%s:443", server), conf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dial %s:443: %s", server, err)
+	}
+
+	req, err := http.NewRequest("GET", getUrl, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create VPN session request: %s", err)
+	}
+	req.Header.Set("User-Agent", userAgentVPN)
+	if err := req.Write(conn); err != nil {
+		return nil, nil, fmt.Errorf("failed to send VPN session request: %s", err)
+	}
+
+	if debug {
+		log.Printf("URL: %s", getUrl)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get initial VPN connection response: %s", err)
+	}
+	resp.Body.Close()
+
+	info := &tunnelInfo{
+		localIPv4:  net.ParseIP(resp.Header.Get("X-VPN-client-IP")),
+		serverIPv4: net.ParseIP(resp.Header.Get("X-VPN-server-IP")),
+		localIPv6:  net.ParseIP(resp.Header.Get("X-VPN-client-IPv6")),
+		serverIPv6: net.ParseIP(resp.Header.Get("X-VPN-server-IPv6")),
+	}
+
+	if debug {
+		log.Printf("Client IP: %s", info.localIPv4)
+		log.Printf("Server IP: %s", info.serverIPv4)
+		if info.localIPv6 != nil {
+			log.Printf("Client IPv6: %s", info.localIPv6)
+		}
+		if info.serverIPv6 != nil {
+			log.Printf("Server IPv6: %s", info.serverIPv6)
+		}
+	}
+
+	return conn, info, nil
+}
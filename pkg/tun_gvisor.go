@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// TunStack selects what backs the local tunnel endpoint: a real kernel
+// interface (created via water or wireguard/tun) or a gVisor userspace
+// network stack that needs no CAP_NET_ADMIN.
+type TunStack string
+
+const (
+	TunStackKernel TunStack = "kernel"
+	TunStackGVisor TunStack = "gvisor"
+)
+
+const nicID tcpip.NICID = 1
+
+// gvisorConn adapts a gVisor channel.Endpoint to the myConn interface, so it
+// can be plugged into myTun exactly like the water/wireguard devices: Write
+// injects a packet arriving from the F5 tunnel into the stack, Read drains a
+// packet the stack emitted for the tunnel.
+type gvisorConn struct {
+	ep     *channel.Endpoint
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (c *gvisorConn) Write(b []byte) (int, error) {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(append([]byte(nil), b...)),
+	})
+	defer pkt.DecRef()
+
+	proto, ok := ipVersionProtocol(b)
+	if !ok {
+		return 0, fmt.Errorf("gvisor: dropping packet with unknown IP version")
+	}
+	c.ep.InjectInbound(proto, pkt)
+	return len(b), nil
+}
+
+func (c *gvisorConn) Read(b []byte) (int, error) {
+	pkt := c.ep.ReadContext(c.ctx)
+	if pkt == nil {
+		return 0, fmt.Errorf("gvisor: endpoint closed")
+	}
+	defer pkt.DecRef()
+
+	view := pkt.ToView()
+	defer view.Release()
+	return copy(b, view.AsSlice()), nil
+}
+
+func (c *gvisorConn) Close() error {
+	c.cancel()
+	c.ep.Close()
+	return nil
+}
+
+// newGvisorTun builds a userspace TCP/IP stack with localIPv4/localIPv6
+// installed as protocol addresses on a single channel-backed NIC, and wraps
+// it as a myTun so the rest of vpnLink can treat it like a kernel interface.
+func newGvisorTun(localIPv4, localIPv6 net.IP, mtu uint16) (myTun, *stack.Stack, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+
+	ep := channel.New(512, uint32(mtu), "")
+	if err := s.CreateNIC(nicID, ep); err != nil {
+		return myTun{}, nil, fmt.Errorf("gvisor: failed to create NIC: %s", err)
+	}
+
+	if localIPv4 != nil {
+		if err := addProtocolAddress(s, ipv4.ProtocolNumber, localIPv4.To4(), 32); err != nil {
+			return myTun{}, nil, err
+		}
+		s.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: nicID})
+	}
+	if localIPv6 != nil {
+		if err := addProtocolAddress(s, ipv6.ProtocolNumber, localIPv6.To16(), 128); err != nil {
+			return myTun{}, nil, err
+		}
+		s.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: nicID})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return myTun{myConn: &gvisorConn{ep: ep, ctx: ctx, cancel: cancel}}, s, nil
+}
+
+func addProtocolAddress(s *stack.Stack, proto tcpip.NetworkProtocolNumber, addr []byte, prefixLen int) error {
+	protoAddr := tcpip.ProtocolAddress{
+		Protocol:          proto,
+		AddressWithPrefix: tcpip.AddressWithPrefix{Address: tcpip.AddrFromSlice(addr), PrefixLen: prefixLen},
+	}
+	if err := s.AddProtocolAddress(nicID, protoAddr, stack.AddressProperties{}); err != nil {
+		return fmt.Errorf("gvisor: failed to assign %s to NIC: %s", protoAddr.AddressWithPrefix, err)
+	}
+	return nil
+}
+
+func ipVersionProtocol(b []byte) (tcpip.NetworkProtocolNumber, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	switch b[0] >> 4 {
+	case 4:
+		return ipv4.ProtocolNumber, true
+	case 6:
+		return ipv6.ProtocolNumber, true
+	default:
+		return 0, false
+	}
+}
+